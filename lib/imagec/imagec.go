@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
@@ -59,6 +60,18 @@ type ImageC struct {
 	ImageLayers []*ImageWithMeta
 	// ImageID is the docker ImageID calculated during download
 	ImageID string
+
+	// imageConfig caches the schema2/OCI image config blob once fetched, so
+	// LayersToDownload and CreateImageConfig don't each fetch it separately.
+	imageConfig *docker.Image
+
+	// imageSource is the transport (registry, archive, layout, directory)
+	// that PullImage resolved Options.Reference to.
+	imageSource ImageSource
+
+	// dedup, when set by a PullSet, single-flights blob fetches by digest
+	// across every image the set is pulling concurrently.
+	dedup *blobDeduper
 }
 
 // NewImageC returns a new instance of ImageC
@@ -107,6 +120,31 @@ type Options struct {
 
 	// RegistryCAs will not be modified by imagec
 	RegistryCAs *x509.CertPool
+
+	// Platform selects a single manifest from a manifest list or OCI image
+	// index when the registry serves a multi-arch image. Defaults to
+	// DefaultPlatform (linux/amd64) when left as the zero value.
+	Platform Platform
+
+	// PolicyPath is the path to a JSON SignaturePolicy file. When set and
+	// SignaturePolicy is nil, PullImage loads it before verifying the pulled
+	// manifest's signature.
+	PolicyPath string
+
+	// SignaturePolicy governs which signatures PullImage will accept for
+	// this image. A nil policy disables signature verification entirely,
+	// preserving imagec's historical unsigned-pull behavior.
+	SignaturePolicy *SignaturePolicy
+
+	// SignatureLookasideURL, when set, is used instead of the registry's
+	// own /extensions/v2/<name>/signatures/<digest> endpoint to fetch
+	// detached signatures.
+	SignatureLookasideURL string
+
+	// ChunkSize, when non-zero, splits a layer blob larger than ChunkSize
+	// into that many bytes per ranged sub-request and fetches them in
+	// parallel. Left at zero, a layer blob downloads as a single request.
+	ChunkSize int64
 }
 
 // ImageWithMeta wraps the models.Image with some additional metadata
@@ -159,8 +197,21 @@ func init() {
 
 // ParseReference parses the -reference parameter and populate options struct
 func (ic *ImageC) ParseReference() error {
+	parsed := ParseSourceReference(ic.Reference)
+
+	// Only the docker:// transport addresses a registry by name/tag; the
+	// others point at a local archive/layout/directory that carries no
+	// registry name, so leave Registry empty, set Image to the
+	// transport-specific value and Tag to the default tag, and let the
+	// ImageSource interpret the reference itself.
+	if parsed.Transport != TransportDocker {
+		ic.Image = parsed.Value
+		ic.Tag = reference.DefaultTag
+		return nil
+	}
+
 	// Validate and parse reference name
-	ref, err := reference.ParseNamed(ic.Reference)
+	ref, err := reference.ParseNamed(parsed.Value)
 	if err != nil {
 		log.Warn("Error while parsing reference %s: %#v", ic.Reference, err)
 		return err
@@ -221,8 +272,55 @@ func DestinationDirectory(options Options) string {
 	)
 }
 
-// LayersToDownload creates a slice of ImageWithMeta for the layers that need to be downloaded
+// parseManifest decodes the raw manifest bytes obtained from an ImageSource
+// into either a schema1 or a schema2/OCI manifest, based on the
+// "schemaVersion" field every manifest format carries.
+func (ic *ImageC) parseManifest(data []byte) error {
+	probe := struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}{}
+
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return fmt.Errorf("Failed to probe manifest: %s", err)
+	}
+
+	if probe.SchemaVersion == 1 {
+		schema1 := &Manifest{}
+		if err := json.Unmarshal(data, schema1); err != nil {
+			return fmt.Errorf("Failed to unmarshal schema1 manifest: %s", err)
+		}
+		ic.ImageManifestSchema1 = schema1
+		return nil
+	}
+
+	schema2Manifest := &schema2.DeserializedManifest{}
+	if err := schema2Manifest.UnmarshalJSON(data); err != nil {
+		return fmt.Errorf("Failed to unmarshal schema2/OCI manifest: %s", err)
+	}
+	ic.ImageManifestSchema2 = schema2Manifest
+	return nil
+}
+
+// LayersToDownload creates a slice of ImageWithMeta for the layers that need
+// to be downloaded. Schema2 and OCI manifests carry their image config
+// separately from the manifest, so they're handled by a distinct code path
+// from schema1's embedded V1Compatibility history.
 func (ic *ImageC) LayersToDownload() ([]*ImageWithMeta, error) {
+	if ic.ImageManifestSchema2 != nil {
+		config, err := ic.fetchImageConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return ic.layersToDownloadSchema2(config)
+	}
+
+	return ic.layersToDownloadSchema1()
+}
+
+// layersToDownloadSchema1 builds the layer list from a schema1 manifest's
+// FSLayers and the per-layer V1Compatibility history it carries.
+func (ic *ImageC) layersToDownloadSchema1() ([]*ImageWithMeta, error) {
 	images := make([]*ImageWithMeta, len(ic.ImageManifestSchema1.FSLayers))
 
 	manifest := ic.ImageManifestSchema1
@@ -266,6 +364,87 @@ func (ic *ImageC) LayersToDownload() ([]*ImageWithMeta, error) {
 	return images, nil
 }
 
+// layersToDownloadSchema2 builds the layer list from a schema2/OCI manifest's
+// layers[] plus the image config's rootfs.diff_ids. Schema2 doesn't carry a
+// V1-style parent/ID chain per layer, so chain IDs are synthesized the same
+// way the Docker engine derives them: the chain ID of a layer is the chain
+// ID of the diffIDs up to and including that layer.
+func (ic *ImageC) layersToDownloadSchema2(config *docker.Image) ([]*ImageWithMeta, error) {
+	manifest := ic.ImageManifestSchema2
+
+	if config.RootFS == nil {
+		return nil, fmt.Errorf("image config has no rootfs")
+	}
+	diffIDs := config.RootFS.DiffIDs
+
+	if len(manifest.Layers) != len(diffIDs) {
+		return nil, fmt.Errorf("schema2 manifest has %d layers but image config has %d diff IDs", len(manifest.Layers), len(diffIDs))
+	}
+
+	n := len(manifest.Layers)
+	images := make([]*ImageWithMeta, n)
+	parent := "scratch"
+
+	// iterate from parent to children
+	for i := 0; i < n; i++ {
+		desc := manifest.Layers[i]
+		chainID := dockerLayer.CreateChainID(diffIDs[:i+1]).String()
+
+		image := &ImageWithMeta{
+			Image: &models.Image{
+				ID:     chainID,
+				Parent: parent,
+				Store:  ic.Storename,
+			},
+			DiffID: diffIDs[i].String(),
+			Layer:  FSLayer{BlobSum: desc.Digest.String()},
+			Size:   desc.Size,
+		}
+
+		// populate manifest layer with existing cached data
+		if cached, err := LayerCache().Get(chainID); err == nil {
+			if !cached.Downloading {
+				image = cached
+			}
+		}
+
+		images[n-1-i] = image
+		parent = chainID
+	}
+
+	return images, nil
+}
+
+// fetchImageConfig retrieves and decodes the image config blob referenced by
+// the schema2/OCI manifest's config descriptor, caching the result for the
+// lifetime of this ImageC instance.
+func (ic *ImageC) fetchImageConfig() (*docker.Image, error) {
+	if ic.imageConfig != nil {
+		return ic.imageConfig, nil
+	}
+
+	configDigest := ic.ImageManifestSchema2.Target().Digest.String()
+
+	blob, _, err := ic.imageSource.GetBlob(context.Background(), configDigest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch image config %s: %s", configDigest, err)
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image config %s: %s", configDigest, err)
+	}
+
+	config := &docker.Image{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal image config %s: %s", configDigest, err)
+	}
+
+	ic.imageConfig = config
+	return config, nil
+}
+
 // updateRepositoryCache will update the repository cache
 // that resides in the docker persona.  This will add image tag,
 // digest and layer information.
@@ -319,8 +498,14 @@ func (ic *ImageC) WriteImageBlob(image *ImageWithMeta, progressOutput progress.O
 	destination := DestinationDirectory(ic.Options)
 
 	id := image.Image.ID
-	log.Infof("Path: %s", path.Join(destination, id, id+".targ"))
-	f, err := os.Open(path.Join(destination, id, id+".tar"))
+	destPath := path.Join(destination, id, id+".tar")
+	log.Infof("Path: %s", destPath)
+
+	if err := ic.ensureLayerBlob(context.Background(), image, destPath, progressOutput); err != nil {
+		return fmt.Errorf("Failed to download layer blob: %s", err)
+	}
+
+	f, err := os.Open(destPath)
 	if err != nil {
 		return fmt.Errorf("Failed to open file: %s", err)
 	}
@@ -368,6 +553,17 @@ func (ic *ImageC) CreateImageConfig(images []*ImageWithMeta) (metadata.ImageConf
 		return *image, nil
 	}
 
+	if ic.ImageManifestSchema2 != nil {
+		return ic.createImageConfigSchema2(images, imageLayer)
+	}
+
+	return ic.createImageConfigSchema1(images, imageLayer)
+}
+
+// createImageConfigSchema1 constructs image metadata from a schema1
+// manifest, where per-layer history comes from each FSLayer's embedded
+// V1Compatibility JSON.
+func (ic *ImageC) createImageConfigSchema1(images []*ImageWithMeta, imageLayer *ImageWithMeta) (metadata.ImageConfig, error) {
 	manifest := ic.ImageManifestSchema1
 	image := docker.V1Image{}
 	rootFS := docker.NewRootFS()
@@ -445,6 +641,49 @@ func (ic *ImageC) CreateImageConfig(images []*ImageWithMeta) (metadata.ImageConf
 	return imageConfig, nil
 }
 
+// createImageConfigSchema2 constructs image metadata from a schema2/OCI
+// manifest, where history and rootfs come from the image config blob rather
+// than from each layer.
+func (ic *ImageC) createImageConfigSchema2(images []*ImageWithMeta, imageLayer *ImageWithMeta) (metadata.ImageConfig, error) {
+	config, err := ic.fetchImageConfig()
+	if err != nil {
+		return metadata.ImageConfig{}, err
+	}
+
+	var size int64
+	for _, layer := range images {
+		size += layer.Size
+	}
+
+	result := *config
+	result.Size = size
+	result.V1Image.ID = imageLayer.ID
+
+	imageConfigBytes, err := result.MarshalJSON()
+	if err != nil {
+		return metadata.ImageConfig{}, fmt.Errorf("Failed to marshall image metadata: %s", err)
+	}
+
+	// calculate image ID
+	sum := fmt.Sprintf("%x", sha256.Sum256(imageConfigBytes))
+	log.Infof("Image ID: sha256:%s", sum)
+
+	imageConfig := metadata.ImageConfig{
+		V1Image: result.V1Image,
+		ImageID: sum,
+		// TODO: this will change when issue 1186 is
+		// implemented -- only populate the digests when pulled by digest
+		Digests:   []string{ic.ManifestDigest},
+		Tags:      []string{ic.Tag},
+		Name:      ic.Image,
+		DiffIDs:   make(map[string]string),
+		History:   result.History,
+		Reference: ic.Reference,
+	}
+
+	return imageConfig, nil
+}
+
 // PullImage pulls an image from docker hub
 func (ic *ImageC) PullImage() error {
 
@@ -479,39 +718,59 @@ func (ic *ImageC) PullImage() error {
 		return err
 	}
 
-	// Calculate (and overwrite) the registry URL and make sure that it responds to requests
-	ic.Registry, err = LearnRegistryURL(&ic.Options)
-	if err != nil {
-		log.Errorf("Error while pulling image: %s", err)
-		return err
-	}
-
-	// Get the URL of the OAuth endpoint
-	url, err := LearnAuthURL(ic.Options)
-	if err != nil {
-		log.Infof(err.Error())
-		switch err := err.(type) {
-		case urlfetcher.ImageNotFoundError:
-			return fmt.Errorf("Error: image %s not found", ic.Reference)
-		default:
-			return fmt.Errorf("Failed to obtain OAuth endpoint: %s", err)
+	// Registry/OAuth discovery only applies to the docker:// transport; a
+	// docker-archive/oci-archive/oci/dir reference has no registry behind
+	// it at all, and ic.Registry is left empty by ParseReference for them.
+	if ParseSourceReference(ic.Reference).Transport == TransportDocker {
+		// Calculate (and overwrite) the registry URL and make sure that it responds to requests
+		ic.Registry, err = LearnRegistryURL(&ic.Options)
+		if err != nil {
+			log.Errorf("Error while pulling image: %s", err)
+			return err
 		}
-	}
 
-	// Get the OAuth token - if only we have a URL
-	if url != nil {
-		token, err := FetchToken(ctx, ic.Options, url, ic.progressOutput)
+		// Get the URL of the OAuth endpoint
+		url, err := LearnAuthURL(ic.Options)
 		if err != nil {
-			log.Errorf("Failed to fetch OAuth token: %s", err)
-			return err
+			log.Infof(err.Error())
+			switch err := err.(type) {
+			case urlfetcher.ImageNotFoundError:
+				return fmt.Errorf("Error: image %s not found", ic.Reference)
+			default:
+				return fmt.Errorf("Failed to obtain OAuth endpoint: %s", err)
+			}
+		}
+
+		// Get the OAuth token - if only we have a URL. A PullSet may have already
+		// supplied a token for this registry from an earlier pull in the set, in
+		// which case it's reused rather than fetched again.
+		if url != nil && ic.Token == nil {
+			token, err := FetchToken(ctx, ic.Options, url, ic.progressOutput)
+			if err != nil {
+				log.Errorf("Failed to fetch OAuth token: %s", err)
+				return err
+			}
+			ic.Token = token
 		}
-		ic.Token = token
 	}
 
 	progress.Message(ic.progressOutput, "", "Pulling from "+ic.Image)
 
-	// Get the schema1 manifest
-	manifest, digest, err := FetchImageManifest(ctx, ic.Options, 1, ic.progressOutput)
+	// The image source abstracts away whether we're pulling from a registry
+	// or reading a local docker-archive/oci-archive/oci/dir transport, so
+	// the rest of the pull flow doesn't need to know which.
+	src, err := NewImageSource(ic.Options, ic.progressOutput)
+	if err != nil {
+		return fmt.Errorf("Failed to create image source: %s", err)
+	}
+	defer src.Close()
+
+	if ic.dedup != nil {
+		src = ic.dedup.wrap(src)
+	}
+	ic.imageSource = src
+
+	manifestBytes, digest, err := src.GetManifest(ctx)
 	if err != nil {
 		log.Infof(err.Error())
 		switch err := err.(type) {
@@ -523,23 +782,23 @@ func (ic *ImageC) PullImage() error {
 			return fmt.Errorf("Error while pulling image manifest: %s", err)
 		}
 	}
-
-	schema1, ok := manifest.(*Manifest)
-	if !ok {
-		return fmt.Errorf("Error pulling manifest schema 1")
-	}
-
-	ic.ImageManifestSchema1 = schema1
 	ic.ManifestDigest = digest
 
-	manifest, digest, err = FetchImageManifest(ctx, ic.Options, 2, ic.progressOutput)
-	if err == nil {
-		if schema2, ok := manifest.(*schema2.DeserializedManifest); ok {
-			ic.ImageManifestSchema2 = schema2
+	if err := ic.parseManifest(manifestBytes); err != nil {
+		return err
+	}
 
-			//Override the manifest digest as Docker uses schema 2
-			ic.ManifestDigest = digest
+	if ic.Options.SignaturePolicy == nil && ic.Options.PolicyPath != "" {
+		policy, err := LoadSignaturePolicy(ic.Options.PolicyPath)
+		if err != nil {
+			return err
 		}
+		ic.Options.SignaturePolicy = policy
+	}
+
+	if err := ic.VerifyManifestSignature(ctx); err != nil {
+		log.Errorf("Signature verification failed: %s", err)
+		return err
 	}
 
 	layers, err := ic.LayersToDownload()
@@ -0,0 +1,159 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	docker "github.com/docker/docker/image"
+	dockerLayer "github.com/docker/docker/layer"
+)
+
+// TestLayersToDownloadSchema2ChainID checks the two things layersToDownloadSchema2
+// has to get right that layersToDownloadSchema1 didn't need to worry about:
+// deriving each layer's ID as the chain ID of its diff IDs up to that point,
+// and mapping that back into the newest-first ImageWithMeta ordering schema1
+// established.
+func TestLayersToDownloadSchema2ChainID(t *testing.T) {
+	rawManifest := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size": 1,
+			"digest": "sha256:` + digestHex("config") + `"
+		},
+		"layers": [
+			{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 100, "digest": "sha256:` + digestHex("base") + `"},
+			{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 200, "digest": "sha256:` + digestHex("app") + `"}
+		]
+	}`)
+
+	manifest := &schema2.DeserializedManifest{}
+	if err := manifest.UnmarshalJSON(rawManifest); err != nil {
+		t.Fatalf("Failed to unmarshal fixture manifest: %s", err)
+	}
+
+	diffIDs := []dockerLayer.DiffID{
+		dockerLayer.DiffID("sha256:" + digestHex("base")),
+		dockerLayer.DiffID("sha256:" + digestHex("app")),
+	}
+
+	config := &docker.Image{
+		RootFS: &docker.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	}
+
+	ic := &ImageC{Options: Options{Storename: "teststore"}}
+	ic.ImageManifestSchema2 = manifest
+
+	images, err := ic.layersToDownloadSchema2(config)
+	if err != nil {
+		t.Fatalf("layersToDownloadSchema2 failed: %s", err)
+	}
+
+	if len(images) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(images))
+	}
+
+	expectedBaseID := dockerLayer.CreateChainID(diffIDs[:1]).String()
+	expectedAppID := dockerLayer.CreateChainID(diffIDs[:2]).String()
+
+	// images[0] is the topmost (newest) layer, matching schema1's ordering,
+	// even though manifest.Layers and diffIDs are oldest-first.
+	if images[0].Image.ID != expectedAppID {
+		t.Errorf("images[0].Image.ID = %s, expected the chain ID over both diff IDs (%s)", images[0].Image.ID, expectedAppID)
+	}
+	if images[0].Image.Parent != expectedBaseID {
+		t.Errorf("images[0].Image.Parent = %s, expected the base layer's chain ID (%s)", images[0].Image.Parent, expectedBaseID)
+	}
+
+	if images[1].Image.ID != expectedBaseID {
+		t.Errorf("images[1].Image.ID = %s, expected the chain ID over the base diff ID alone (%s)", images[1].Image.ID, expectedBaseID)
+	}
+	if images[1].Image.Parent != "scratch" {
+		t.Errorf("images[1].Image.Parent = %s, expected \"scratch\" for the base layer", images[1].Image.Parent)
+	}
+}
+
+func TestLayersToDownloadSchema2LayerCountMismatch(t *testing.T) {
+	rawManifest := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": 1, "digest": "sha256:` + digestHex("config") + `"},
+		"layers": [
+			{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 100, "digest": "sha256:` + digestHex("base") + `"}
+		]
+	}`)
+
+	manifest := &schema2.DeserializedManifest{}
+	if err := manifest.UnmarshalJSON(rawManifest); err != nil {
+		t.Fatalf("Failed to unmarshal fixture manifest: %s", err)
+	}
+
+	config := &docker.Image{
+		RootFS: &docker.RootFS{
+			Type: "layers",
+			DiffIDs: []dockerLayer.DiffID{
+				dockerLayer.DiffID("sha256:" + digestHex("base")),
+				dockerLayer.DiffID("sha256:" + digestHex("extra")),
+			},
+		},
+	}
+
+	ic := &ImageC{}
+	ic.ImageManifestSchema2 = manifest
+
+	if _, err := ic.layersToDownloadSchema2(config); err == nil {
+		t.Fatal("expected an error when manifest layer count doesn't match config diff ID count")
+	}
+}
+
+func TestLayersToDownloadSchema2NilRootFS(t *testing.T) {
+	rawManifest := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": 1, "digest": "sha256:` + digestHex("config") + `"},
+		"layers": [
+			{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 100, "digest": "sha256:` + digestHex("base") + `"}
+		]
+	}`)
+
+	manifest := &schema2.DeserializedManifest{}
+	if err := manifest.UnmarshalJSON(rawManifest); err != nil {
+		t.Fatalf("Failed to unmarshal fixture manifest: %s", err)
+	}
+
+	ic := &ImageC{}
+	ic.ImageManifestSchema2 = manifest
+
+	if _, err := ic.layersToDownloadSchema2(&docker.Image{}); err == nil {
+		t.Fatal("expected an error for an image config with no rootfs, not a panic")
+	}
+}
+
+// digestHex returns a deterministic, valid-looking 64 character hex digest
+// for seed, so fixtures don't need to hardcode long hex strings.
+func digestHex(seed string) string {
+	const hex = "0123456789abcdef"
+	out := make([]byte, 64)
+	for i := range out {
+		out[i] = hex[int(seed[i%len(seed)])%len(hex)]
+	}
+	return string(out)
+}
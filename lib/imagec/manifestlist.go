@@ -0,0 +1,169 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/pkg/progress"
+)
+
+const (
+	// MediaTypeManifestList is the media type for a Docker Distribution
+	// manifest list (multi-arch manifest).
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeOCIManifest is the media type for a single-platform OCI
+	// image-spec manifest.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIImageIndex is the media type for an OCI image-spec image
+	// index, the OCI equivalent of a Docker manifest list.
+	MediaTypeOCIImageIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+// Platform identifies the OS/architecture pair used to select a single
+// manifest out of a manifest list or OCI image index.
+type Platform struct {
+	OS           string
+	Architecture string
+}
+
+// DefaultPlatform is used whenever Options.Platform is the zero value.
+var DefaultPlatform = Platform{OS: "linux", Architecture: "amd64"}
+
+// String returns the "os/architecture" form of the platform, e.g. "linux/amd64".
+func (p Platform) String() string {
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// ManifestDescriptor is a single entry of a ManifestList, describing a
+// platform-specific manifest that the list points to.
+type ManifestDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+	Platform  struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+	// Annotations carries OCI image index annotations, notably
+	// "org.opencontainers.image.ref.name", which local OCI layouts use in
+	// place of a registry tag.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ManifestList represents either a Docker Distribution manifest list or an
+// OCI image index; the two share the same JSON shape for our purposes.
+type ManifestList struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []ManifestDescriptor `json:"manifests"`
+}
+
+// IsManifestListMediaType returns true if mediaType identifies a manifest
+// list or OCI image index rather than a concrete, single-platform manifest.
+func IsManifestListMediaType(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeManifestList, MediaTypeOCIImageIndex:
+		return true
+	default:
+		return false
+	}
+}
+
+// UnmarshalManifestList parses raw JSON into a ManifestList.
+func UnmarshalManifestList(data []byte) (*ManifestList, error) {
+	list := &ManifestList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal manifest list: %s", err)
+	}
+	return list, nil
+}
+
+// SelectDescriptor returns the ManifestDescriptor in the list whose platform
+// matches the given platform exactly.
+func (m *ManifestList) SelectDescriptor(platform Platform) (*ManifestDescriptor, error) {
+	for i := range m.Manifests {
+		d := &m.Manifests[i]
+		if d.Platform.OS == platform.OS && d.Platform.Architecture == platform.Architecture {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("no manifest found in manifest list for platform %s", platform)
+}
+
+// resolveManifestList selects the manifest matching platform out of a
+// manifest list / OCI image index, then fetches the concrete manifest it
+// references from the registry so that the normal pull flow can continue
+// unmodified. It's only meaningful for the docker:// transport; local
+// archive/layout sources select their platform-specific manifest directly
+// out of their own index.
+func resolveManifestList(ctx context.Context, options Options, imageName string, list *ManifestList, platform Platform, progressOutput progress.Output) (interface{}, string, error) {
+	if platform == (Platform{}) {
+		platform = DefaultPlatform
+	}
+
+	desc, err := list.SelectDescriptor(platform)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error selecting manifest for platform %s: %s", platform, err)
+	}
+
+	log.Infof("Resolved manifest list to %s for platform %s", desc.Digest, platform)
+
+	childOptions := options
+	childOptions.Reference = fmt.Sprintf("%s@%s", imageName, desc.Digest)
+
+	manifest, digest, err := FetchImageManifest(ctx, childOptions, 2, progressOutput)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error while pulling platform-specific manifest %s: %s", desc.Digest, err)
+	}
+
+	switch manifest.(type) {
+	case *schema2.DeserializedManifest:
+	default:
+		return nil, "", fmt.Errorf("Manifest referenced by manifest list %s was not a schema2 or OCI manifest", desc.Digest)
+	}
+
+	return manifest, digest, nil
+}
+
+// selectOCIDescriptor picks the manifest list entry tagged refName via the
+// "org.opencontainers.image.ref.name" annotation, as used by on-disk OCI
+// layouts in place of a registry tag. With no tag given, a layout containing
+// exactly one manifest is accepted unambiguously.
+func selectOCIDescriptor(index *ManifestList, refName string) (*ManifestDescriptor, error) {
+	const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+	if refName == "" {
+		if len(index.Manifests) == 1 {
+			return &index.Manifests[0], nil
+		}
+		return nil, fmt.Errorf("layout has %d manifests and no tag was given", len(index.Manifests))
+	}
+
+	for i := range index.Manifests {
+		if index.Manifests[i].Annotations[refNameAnnotation] == refName {
+			return &index.Manifests[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest tagged %q in layout", refName)
+}
@@ -0,0 +1,107 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import "testing"
+
+func testManifestList() *ManifestList {
+	return &ManifestList{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifestList,
+		Manifests: []ManifestDescriptor{
+			{
+				MediaType: MediaTypeOCIManifest,
+				Digest:    "sha256:amd64digest",
+				Platform: struct {
+					Architecture string `json:"architecture"`
+					OS           string `json:"os"`
+				}{Architecture: "amd64", OS: "linux"},
+			},
+			{
+				MediaType: MediaTypeOCIManifest,
+				Digest:    "sha256:armdigest",
+				Platform: struct {
+					Architecture string `json:"architecture"`
+					OS           string `json:"os"`
+				}{Architecture: "arm64", OS: "linux"},
+			},
+		},
+	}
+}
+
+func TestSelectDescriptorMatch(t *testing.T) {
+	list := testManifestList()
+
+	desc, err := list.SelectDescriptor(Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if desc.Digest != "sha256:armdigest" {
+		t.Errorf("expected arm64 digest, got %s", desc.Digest)
+	}
+}
+
+func TestSelectDescriptorNoMatch(t *testing.T) {
+	list := testManifestList()
+
+	if _, err := list.SelectDescriptor(Platform{OS: "windows", Architecture: "amd64"}); err == nil {
+		t.Fatal("expected an error for a platform not in the list")
+	}
+}
+
+func TestSelectOCIDescriptorByAnnotation(t *testing.T) {
+	index := &ManifestList{
+		Manifests: []ManifestDescriptor{
+			{Digest: "sha256:one", Annotations: map[string]string{"org.opencontainers.image.ref.name": "v1"}},
+			{Digest: "sha256:two", Annotations: map[string]string{"org.opencontainers.image.ref.name": "v2"}},
+		},
+	}
+
+	desc, err := selectOCIDescriptor(index, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if desc.Digest != "sha256:two" {
+		t.Errorf("expected v2's digest, got %s", desc.Digest)
+	}
+
+	if _, err := selectOCIDescriptor(index, "missing"); err == nil {
+		t.Fatal("expected an error for a ref not in the index")
+	}
+}
+
+func TestSelectOCIDescriptorSingleManifestNoTag(t *testing.T) {
+	index := &ManifestList{
+		Manifests: []ManifestDescriptor{{Digest: "sha256:only"}},
+	}
+
+	desc, err := selectOCIDescriptor(index, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if desc.Digest != "sha256:only" {
+		t.Errorf("expected the lone manifest's digest, got %s", desc.Digest)
+	}
+}
+
+func TestSelectOCIDescriptorAmbiguousNoTag(t *testing.T) {
+	index := &ManifestList{
+		Manifests: []ManifestDescriptor{{Digest: "sha256:one"}, {Digest: "sha256:two"}},
+	}
+
+	if _, err := selectOCIDescriptor(index, ""); err == nil {
+		t.Fatal("expected an error when no tag is given and the layout has more than one manifest")
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/streamformatter"
+
+	urlfetcher "github.com/vmware/vic/pkg/fetcher"
+)
+
+// defaultPullSetConcurrency is used when PullSetOptions.Concurrency is left
+// at zero.
+const defaultPullSetConcurrency = 4
+
+// PullRequest is one image to pull as part of a PullSet. Platforms, if
+// non-empty, pulls Options.Reference once per platform -- the natural way to
+// request every (or several) architectures out of a single manifest list or
+// OCI image index.
+type PullRequest struct {
+	Options   Options
+	Platforms []Platform
+}
+
+// PullSetOptions configures a PullSet's concurrency and progress reporting.
+type PullSetOptions struct {
+	// Concurrency caps how many images this set downloads at once, across
+	// all registries. Defaults to defaultPullSetConcurrency.
+	Concurrency int
+
+	// PerRegistryConcurrency caps how many images from a single registry
+	// download at once, keyed by registry host. A registry with no entry
+	// falls back to Concurrency. This lets a set pull many images from a
+	// fast internal registry while still being polite to a rate-limited
+	// public one.
+	PerRegistryConcurrency map[string]int
+
+	// Output receives progress for every image in the set, each line
+	// prefixed with the image's reference so a caller can tell them apart.
+	Output progress.Output
+}
+
+// PullSet pulls many images concurrently, sharing one LayerDownloader, one
+// authenticated session per registry, and a blob cache so images that share
+// a base layer only download it once.
+type PullSet struct {
+	concurrency   int
+	registryCaps  map[string]int
+	globalSem     chan struct{}
+	registrySemMu sync.Mutex
+	registrySems  map[string]chan struct{}
+
+	tokenMu sync.Mutex
+	tokens  map[string]*urlfetcher.Token
+
+	dedup    *blobDeduper
+	progress *mergedProgress
+}
+
+// NewPullSet builds a PullSet ready to Pull.
+func NewPullSet(opts PullSetOptions) *PullSet {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultPullSetConcurrency
+	}
+
+	return &PullSet{
+		concurrency:  concurrency,
+		registryCaps: opts.PerRegistryConcurrency,
+		globalSem:    make(chan struct{}, concurrency),
+		registrySems: make(map[string]chan struct{}),
+		tokens:       make(map[string]*urlfetcher.Token),
+		dedup:        newBlobDeduper(),
+		progress:     &mergedProgress{out: opts.Output},
+	}
+}
+
+// Pull pulls every request in requests concurrently, expanding any
+// multi-platform requests first, and returns the first error encountered (if
+// any); every request still runs to completion regardless.
+func (ps *PullSet) Pull(ctx context.Context, requests []PullRequest) error {
+	defer ps.dedup.cleanup()
+
+	expanded := expandPullRequests(requests)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(expanded))
+
+	for i, req := range expanded {
+		wg.Add(1)
+		go func(i int, req PullRequest) {
+			defer wg.Done()
+			errs[i] = ps.pullOne(ctx, req)
+		}(i, req)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandPullRequests turns each PullRequest with Platforms set into one
+// PullRequest per platform, leaving single-platform requests untouched.
+func expandPullRequests(requests []PullRequest) []PullRequest {
+	var expanded []PullRequest
+
+	for _, req := range requests {
+		if len(req.Platforms) == 0 {
+			expanded = append(expanded, req)
+			continue
+		}
+
+		for _, platform := range req.Platforms {
+			r := req
+			r.Options.Platform = platform
+			r.Platforms = nil
+			expanded = append(expanded, r)
+		}
+	}
+
+	return expanded
+}
+
+func (ps *PullSet) pullOne(ctx context.Context, req PullRequest) error {
+	ic := NewImageC(req.Options, streamformatter.NewJSONStreamFormatter())
+
+	if err := ic.ParseReference(); err != nil {
+		return err
+	}
+
+	ps.globalSem <- struct{}{}
+	defer func() { <-ps.globalSem }()
+
+	// PullImage overwrites ic.Registry with the registry's full URL, so keep
+	// the host ParseReference found as the key for the shared token.
+	registry := ic.Registry
+
+	registrySem := ps.registrySemaphore(registry)
+	registrySem <- struct{}{}
+	defer func() { <-registrySem }()
+
+	ic.Token = ps.token(registry)
+	ic.dedup = ps.dedup
+	ic.progressOutput = ps.progress.forImage(req.Options.Reference)
+
+	err := ic.PullImage()
+	if ic.Token != nil {
+		ps.setToken(registry, ic.Token)
+	}
+
+	return err
+}
+
+func (ps *PullSet) registrySemaphore(registry string) chan struct{} {
+	ps.registrySemMu.Lock()
+	defer ps.registrySemMu.Unlock()
+
+	if sem, ok := ps.registrySems[registry]; ok {
+		return sem
+	}
+
+	cap := ps.registryCaps[registry]
+	if cap <= 0 {
+		cap = ps.concurrency
+	}
+
+	sem := make(chan struct{}, cap)
+	ps.registrySems[registry] = sem
+	return sem
+}
+
+func (ps *PullSet) token(registry string) *urlfetcher.Token {
+	ps.tokenMu.Lock()
+	defer ps.tokenMu.Unlock()
+	return ps.tokens[registry]
+}
+
+func (ps *PullSet) setToken(registry string, token *urlfetcher.Token) {
+	ps.tokenMu.Lock()
+	defer ps.tokenMu.Unlock()
+	ps.tokens[registry] = token
+}
+
+// mergedProgress fans the per-image progress stream each ImageC produces
+// into a single progress.Output, tagging each entry with the image
+// reference it came from so a caller watching the merged stream can tell
+// which image a given line belongs to.
+type mergedProgress struct {
+	mu  sync.Mutex
+	out progress.Output
+}
+
+func (m *mergedProgress) forImage(reference string) progress.Output {
+	return progressWriterFunc(func(p progress.Progress) error {
+		p.ID = reference + ": " + p.ID
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.out.WriteProgress(p)
+	})
+}
+
+// progressWriterFunc adapts a plain function to progress.Output.
+type progressWriterFunc func(progress.Progress) error
+
+func (f progressWriterFunc) WriteProgress(p progress.Progress) error {
+	return f(p)
+}
+
+// inFlightBlob is the shared state for one digest being downloaded by the
+// first of possibly several concurrent images that reference it.
+type inFlightBlob struct {
+	done chan struct{}
+	path string
+	size int64
+	err  error
+}
+
+// blobDeduper single-flights GetBlob calls by digest across every ImageC a
+// PullSet is running, so two images sharing a base layer only download it
+// once. The first caller for a digest downloads it to a temp file; every
+// other caller waits for that download and then opens its own handle to the
+// same file.
+type blobDeduper struct {
+	mu    sync.Mutex
+	blobs map[string]*inFlightBlob
+}
+
+func newBlobDeduper() *blobDeduper {
+	return &blobDeduper{blobs: make(map[string]*inFlightBlob)}
+}
+
+func (d *blobDeduper) wrap(src ImageSource) ImageSource {
+	return &dedupingImageSource{inner: src, deduper: d}
+}
+
+func (d *blobDeduper) getBlob(ctx context.Context, digest string, inner ImageSource) (io.ReadCloser, int64, error) {
+	d.mu.Lock()
+	blob, exists := d.blobs[digest]
+	if !exists {
+		blob = &inFlightBlob{done: make(chan struct{})}
+		d.blobs[digest] = blob
+	}
+	d.mu.Unlock()
+
+	if !exists {
+		blob.path, blob.size, blob.err = downloadToTempFile(ctx, digest, inner)
+		close(blob.done)
+	} else {
+		select {
+		case <-blob.done:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	if blob.err != nil {
+		return nil, 0, blob.err
+	}
+
+	f, err := os.Open(blob.path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return f, blob.size, nil
+}
+
+func downloadToTempFile(ctx context.Context, digest string, inner ImageSource) (string, int64, error) {
+	rc, size, err := inner.GetBlob(ctx, digest)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile("", "imagec-blob-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, rc); err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+
+	return tmp.Name(), size, nil
+}
+
+// cleanup removes every temp file the deduper created. Call it once the
+// PullSet's pulls have all finished with their blobs.
+func (d *blobDeduper) cleanup() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, blob := range d.blobs {
+		if blob.path != "" {
+			os.Remove(blob.path)
+		}
+	}
+}
+
+// dedupingImageSource wraps an ImageSource so that GetBlob is single-flighted
+// through a shared blobDeduper; GetManifest and Close pass through unchanged
+// since manifests are small and sources own their own lifecycle.
+type dedupingImageSource struct {
+	inner   ImageSource
+	deduper *blobDeduper
+}
+
+func (s *dedupingImageSource) GetManifest(ctx context.Context) ([]byte, string, error) {
+	return s.inner.GetManifest(ctx)
+}
+
+func (s *dedupingImageSource) GetBlob(ctx context.Context, digest string) (io.ReadCloser, int64, error) {
+	return s.deduper.getBlob(ctx, digest, s.inner)
+}
+
+// GetBlobRange only single-flights whole-blob requests (offset 0, no
+// length cap), which is what a first-time layer download looks like; a
+// resumed or chunked partial request bypasses the dedup cache and goes
+// straight to the underlying source, since two images resuming from
+// different offsets have nothing in common to share.
+func (s *dedupingImageSource) GetBlobRange(ctx context.Context, digest string, offset, length int64) (io.ReadCloser, int64, bool, error) {
+	if offset == 0 && length <= 0 {
+		rc, size, err := s.deduper.getBlob(ctx, digest, s.inner)
+		return rc, size, false, err
+	}
+	return s.inner.GetBlobRange(ctx, digest, offset, length)
+}
+
+func (s *dedupingImageSource) Close() error {
+	return s.inner.Close()
+}
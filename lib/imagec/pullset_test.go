@@ -0,0 +1,172 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpandPullRequestsNoPlatforms(t *testing.T) {
+	requests := []PullRequest{
+		{Options: Options{Reference: "busybox:latest"}},
+	}
+
+	expanded := expandPullRequests(requests)
+	if len(expanded) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(expanded))
+	}
+	if expanded[0].Options.Reference != "busybox:latest" {
+		t.Errorf("expected the single-platform request to pass through unchanged, got %+v", expanded[0])
+	}
+}
+
+func TestExpandPullRequestsMultiPlatform(t *testing.T) {
+	requests := []PullRequest{
+		{
+			Options: Options{Reference: "busybox:latest"},
+			Platforms: []Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+			},
+		},
+		{Options: Options{Reference: "alpine:latest"}},
+	}
+
+	expanded := expandPullRequests(requests)
+	if len(expanded) != 3 {
+		t.Fatalf("expected 3 requests (2 expanded + 1 passthrough), got %d", len(expanded))
+	}
+
+	for _, req := range expanded[:2] {
+		if req.Options.Reference != "busybox:latest" {
+			t.Errorf("expected expanded request to keep the original reference, got %s", req.Options.Reference)
+		}
+		if len(req.Platforms) != 0 {
+			t.Errorf("expected the expanded request's Platforms to be cleared, got %+v", req.Platforms)
+		}
+	}
+	if expanded[0].Options.Platform.Architecture != "amd64" || expanded[1].Options.Platform.Architecture != "arm64" {
+		t.Errorf("expected one expanded request per platform in order, got %+v", expanded[:2])
+	}
+
+	if expanded[2].Options.Reference != "alpine:latest" {
+		t.Errorf("expected the single-platform request to pass through unchanged, got %+v", expanded[2])
+	}
+}
+
+// countingSource is an ImageSource whose GetBlob blocks until release is
+// closed, counting how many times it's actually called -- used to assert
+// that blobDeduper only calls through to the inner source once per digest
+// no matter how many concurrent callers ask for it.
+type countingSource struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (s *countingSource) GetManifest(ctx context.Context) ([]byte, string, error) {
+	return nil, "", nil
+}
+
+func (s *countingSource) GetBlob(ctx context.Context, digest string) (io.ReadCloser, int64, error) {
+	atomic.AddInt32(&s.calls, 1)
+	<-s.release
+	return ioutil.NopCloser(bytes.NewReader([]byte("blob-" + digest))), int64(len("blob-" + digest)), nil
+}
+
+func (s *countingSource) GetBlobRange(ctx context.Context, digest string, offset, length int64) (io.ReadCloser, int64, bool, error) {
+	rc, size, err := s.GetBlob(ctx, digest)
+	return rc, size, false, err
+}
+
+func (s *countingSource) Close() error { return nil }
+
+func TestBlobDeduperSingleFlightsConcurrentCallers(t *testing.T) {
+	src := &countingSource{release: make(chan struct{})}
+	deduper := newBlobDeduper()
+	defer deduper.cleanup()
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make([]string, callers)
+	errs := make([]error, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc, _, err := deduper.getBlob(context.Background(), "sha256:shared", src)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer rc.Close()
+			data, err := ioutil.ReadAll(rc)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = string(data)
+		}(i)
+	}
+
+	// Give every goroutine a chance to reach getBlob and block on the first
+	// caller's in-flight download before releasing it.
+	time.Sleep(50 * time.Millisecond)
+	close(src.release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: unexpected error: %s", i, err)
+		}
+	}
+	for i, result := range results {
+		if result != "blob-sha256:shared" {
+			t.Errorf("caller %d got %q, expected the shared blob contents", i, result)
+		}
+	}
+
+	if got := atomic.LoadInt32(&src.calls); got != 1 {
+		t.Errorf("inner source.GetBlob was called %d times, expected exactly 1", got)
+	}
+}
+
+func TestRegistrySemaphorePerRegistryCap(t *testing.T) {
+	ps := NewPullSet(PullSetOptions{
+		Concurrency:            10,
+		PerRegistryConcurrency: map[string]int{"limited.example.com": 1},
+	})
+
+	semA := ps.registrySemaphore("limited.example.com")
+	if cap(semA) != 1 {
+		t.Fatalf("expected limited.example.com's semaphore to have capacity 1, got %d", cap(semA))
+	}
+
+	if sem := ps.registrySemaphore("limited.example.com"); sem != semA {
+		t.Error("expected a second call for the same registry to return the same semaphore")
+	}
+
+	semB := ps.registrySemaphore("unlimited.example.com")
+	if cap(semB) != 10 {
+		t.Errorf("expected a registry with no configured cap to fall back to Concurrency (10), got %d", cap(semB))
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/pkg/progress"
+)
+
+// blobMeta is the sidecar persisted alongside a "<id>.tar.part" file so a
+// later attempt knows what digest and size the partial download is for,
+// without trusting the part file's size alone (which could belong to a
+// stale download of a since-changed blob).
+type blobMeta struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+func loadBlobMeta(metaPath string) (*blobMeta, bool) {
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, false
+	}
+
+	meta := &blobMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, false
+	}
+
+	return meta, true
+}
+
+func saveBlobMeta(metaPath string, meta *blobMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(metaPath, data, 0644)
+}
+
+// ensureLayerBlob makes sure destPath holds the complete, digest-verified
+// layer blob, downloading (or resuming a previous partial download of) it
+// first if necessary. An already-present destPath is trusted as-is, matching
+// imagec's historical behavior of treating a finished "<id>.tar" as done.
+func (ic *ImageC) ensureLayerBlob(ctx context.Context, image *ImageWithMeta, destPath string, progressOutput progress.Output) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return nil
+	}
+
+	digest := image.Layer.BlobSum
+	size := image.Size
+
+	if ic.Options.ChunkSize > 0 && size > ic.Options.ChunkSize {
+		return downloadBlobChunked(ctx, ic.imageSource, digest, destPath, size, ic.Options.ChunkSize, progressOutput)
+	}
+
+	return downloadBlobResumable(ctx, ic.imageSource, digest, destPath, size, progressOutput)
+}
+
+// downloadBlobResumable fetches digest to destPath as a single stream
+// through src, resuming from "<destPath>.part" when a previous attempt left
+// one behind. It asks src.GetBlobRange for the resume offset; if the source
+// can't honor it (for a registry, that's it answering 200 instead of 206),
+// the partial data can't be trusted to line up, so the part file is
+// truncated and the download starts over from the beginning.
+func downloadBlobResumable(ctx context.Context, src ImageSource, digest, destPath string, size int64, progressOutput progress.Output) error {
+	partPath := destPath + ".part"
+	metaPath := destPath + ".meta"
+
+	var offset int64
+	if meta, ok := loadBlobMeta(metaPath); ok && meta.Digest == digest {
+		if fi, err := os.Stat(partPath); err == nil {
+			offset = fi.Size()
+		}
+	} else {
+		os.Remove(partPath)
+	}
+
+	if err := saveBlobMeta(metaPath, &blobMeta{Digest: digest, Size: size}); err != nil {
+		return fmt.Errorf("Failed to write download sidecar: %s", err)
+	}
+
+	rc, _, partial, err := src.GetBlobRange(ctx, digest, offset, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch blob %s: %s", digest, err)
+	}
+	defer rc.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if partial && offset > 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+		offset = 0
+	}
+
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open part file: %s", err)
+	}
+
+	hasher := sha256.New()
+	if offset > 0 {
+		existing, err := os.Open(partPath)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Failed to read existing part file: %s", err)
+		}
+		_, err = io.Copy(hasher, existing)
+		existing.Close()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Failed to hash existing part file: %s", err)
+		}
+	}
+
+	in := progress.NewProgressReader(rc, progressOutput, size-offset, digest, "Downloading")
+	_, err = io.Copy(io.MultiWriter(f, hasher), in)
+	in.Close()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to download blob %s: %s", digest, err)
+	}
+
+	return finishBlobDownload(hasher.Sum(nil), digest, partPath, metaPath, destPath)
+}
+
+// downloadBlobChunked splits a blob larger than chunkSize into chunkSize-byte
+// ranged sub-requests, fetches them concurrently through src, and writes
+// each directly to its offset in "<destPath>.part". It always starts every
+// chunk fresh rather than resuming individual chunks; it's the whole-blob
+// digest check on the reassembled file, not per-chunk bookkeeping, that
+// makes a chunked download safe to retry.
+func downloadBlobChunked(ctx context.Context, src ImageSource, digest, destPath string, size, chunkSize int64, progressOutput progress.Output) error {
+	partPath := destPath + ".part"
+	metaPath := destPath + ".meta"
+
+	if err := saveBlobMeta(metaPath, &blobMeta{Digest: digest, Size: size}); err != nil {
+		return fmt.Errorf("Failed to write download sidecar: %s", err)
+	}
+
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open part file: %s", err)
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to preallocate part file: %s", err)
+	}
+
+	// progress.Output isn't safe for concurrent writers (see mergedProgress
+	// in pullset.go), so every chunk goroutine reports through the same
+	// mutex-guarded wrapper rather than the bare progressOutput.
+	safeProgress := &syncProgress{out: progressOutput}
+
+	numChunks := (size + chunkSize - 1) / chunkSize
+	errs := make([]error, numChunks)
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < numChunks; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+
+			start := i * chunkSize
+			length := chunkSize
+			if start+length > size {
+				length = size - start
+			}
+
+			rc, _, _, err := src.GetBlobRange(ctx, digest, start, length)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer rc.Close()
+
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(rc, buf); err != nil {
+				errs[i] = err
+				return
+			}
+
+			if _, err := f.WriteAt(buf, start); err != nil {
+				errs[i] = err
+				return
+			}
+
+			progress.Update(safeProgress, digest, fmt.Sprintf("Downloaded chunk %d/%d", i+1, numChunks))
+		}(i)
+	}
+	wg.Wait()
+	f.Close()
+
+	for _, err := range errs {
+		if err != nil {
+			os.Remove(partPath)
+			os.Remove(metaPath)
+			return fmt.Errorf("Failed to download blob %s: %s", digest, err)
+		}
+	}
+
+	sum, err := sha256File(partPath)
+	if err != nil {
+		return err
+	}
+
+	return finishBlobDownload(sum, digest, partPath, metaPath, destPath)
+}
+
+// syncProgress guards a progress.Output with a mutex so concurrent chunk
+// downloads, each reporting from their own goroutine, don't race on it the
+// way a bare progress.Output isn't safe for.
+type syncProgress struct {
+	mu  sync.Mutex
+	out progress.Output
+}
+
+func (s *syncProgress) WriteProgress(p progress.Progress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.WriteProgress(p)
+}
+
+func sha256File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reopen part file: %s", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, fmt.Errorf("Failed to hash part file: %s", err)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// finishBlobDownload verifies sum against digest and, on a match, renames
+// partPath into place as the final blob and drops the now-unneeded sidecar.
+// On a mismatch the part file and sidecar are removed so the next attempt
+// starts clean rather than resuming corrupt data.
+func finishBlobDownload(sum []byte, digest, partPath, metaPath, destPath string) error {
+	got := fmt.Sprintf("sha256:%x", sum)
+	if got != digest {
+		os.Remove(partPath)
+		os.Remove(metaPath)
+		return fmt.Errorf("downloaded blob does not match expected digest %s (got %s)", digest, got)
+	}
+
+	if err := os.Rename(partPath, destPath); err != nil {
+		return fmt.Errorf("Failed to finalize downloaded blob: %s", err)
+	}
+
+	os.Remove(metaPath)
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobMetaRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec-blobmeta-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metaPath := filepath.Join(dir, "layer.tar.meta")
+	want := &blobMeta{Digest: "sha256:abc123", Size: 4096}
+
+	if err := saveBlobMeta(metaPath, want); err != nil {
+		t.Fatalf("saveBlobMeta failed: %s", err)
+	}
+
+	got, ok := loadBlobMeta(metaPath)
+	if !ok {
+		t.Fatal("loadBlobMeta did not find the sidecar it just wrote")
+	}
+	if *got != *want {
+		t.Errorf("loadBlobMeta = %+v, expected %+v", got, want)
+	}
+}
+
+func TestLoadBlobMetaMissing(t *testing.T) {
+	if _, ok := loadBlobMeta("/no/such/path.meta"); ok {
+		t.Error("expected loadBlobMeta to report false for a nonexistent sidecar")
+	}
+}
+
+func TestLoadBlobMetaCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec-blobmeta-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metaPath := filepath.Join(dir, "layer.tar.meta")
+	if err := ioutil.WriteFile(metaPath, []byte("not json"), 0644); err != nil {
+		t.Fatalf("Failed to write corrupt sidecar: %s", err)
+	}
+
+	if _, ok := loadBlobMeta(metaPath); ok {
+		t.Error("expected loadBlobMeta to report false for a corrupt sidecar")
+	}
+}
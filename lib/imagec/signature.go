@@ -0,0 +1,438 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PolicyRequirementType is the kind of trust a PolicyRequirement expresses,
+// named after the equivalent requirement types in containers/image's
+// "simple signing" policy.json format.
+type PolicyRequirementType string
+
+const (
+	// PolicyInsecureAcceptAnything accepts the image with no signature check.
+	PolicyInsecureAcceptAnything PolicyRequirementType = "insecureAcceptAnything"
+
+	// PolicyReject refuses to pull the image unconditionally.
+	PolicyReject PolicyRequirementType = "reject"
+
+	// PolicySignedBy requires a valid GPG signature from one of
+	// KeyFingerprints, loaded from the armored keyring at KeyPath.
+	PolicySignedBy PolicyRequirementType = "signedBy"
+
+	// PolicySigstoreSigned requires a valid cosign/sigstore signature from
+	// the PEM-encoded public key at KeyPath.
+	PolicySigstoreSigned PolicyRequirementType = "sigstoreSigned"
+)
+
+// PolicyRequirement is a single trust rule within a SignaturePolicy.
+type PolicyRequirement struct {
+	Type PolicyRequirementType `json:"type"`
+
+	// KeyPath is the armored GPG keyring (signedBy) or PEM public key
+	// (sigstoreSigned) that signatures are checked against.
+	KeyPath string `json:"keyPath,omitempty"`
+
+	// KeyFingerprints restricts signedBy to these GPG key fingerprints; if
+	// empty, any key in the keyring at KeyPath is accepted.
+	KeyFingerprints []string `json:"keyFingerprints,omitempty"`
+}
+
+// SignaturePolicy is a minimal, per-registry "simple signing" policy: a
+// default set of requirements, overridable per registry or per
+// registry/repository.
+type SignaturePolicy struct {
+	Default    []PolicyRequirement            `json:"default"`
+	Registries map[string][]PolicyRequirement `json:"registries,omitempty"`
+}
+
+// LoadSignaturePolicy reads and parses a SignaturePolicy from path.
+func LoadSignaturePolicy(path string) (*SignaturePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read signature policy %s: %s", path, err)
+	}
+
+	policy := &SignaturePolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal signature policy %s: %s", path, err)
+	}
+
+	return policy, nil
+}
+
+// requirementsFor returns the requirements that apply to image on registry,
+// preferring a "registry/image" entry, then a bare "registry" entry, then
+// falling back to Default.
+func (p *SignaturePolicy) requirementsFor(registry, image string) []PolicyRequirement {
+	if reqs, ok := p.Registries[registry+"/"+image]; ok {
+		return reqs
+	}
+	if reqs, ok := p.Registries[registry]; ok {
+		return reqs
+	}
+	return p.Default
+}
+
+// SignatureVerificationError is returned when a pull is refused because no
+// configured PolicyRequirement was satisfied.
+type SignatureVerificationError struct {
+	Image  string
+	Digest string
+	Reason string
+}
+
+func (e *SignatureVerificationError) Error() string {
+	return fmt.Sprintf("signature verification failed for %s@%s: %s", e.Image, e.Digest, e.Reason)
+}
+
+// signatureVerificationCache remembers the verification result for a
+// registry/digest/policy combination for the lifetime of the process, since
+// the same base image digest is often pulled by many references. The key
+// includes the registry and a hash of the applicable requirements, not just
+// the digest, so a second registry serving the same digest -- or the same
+// registry under a later-tightened policy -- doesn't inherit a cached
+// verdict it never actually earned.
+var signatureVerificationCache = struct {
+	sync.Mutex
+	verified map[string]bool
+}{verified: make(map[string]bool)}
+
+// signatureCacheKey scopes a cache entry to the registry and digest being
+// verified plus the requirements applied, so neither a different registry
+// nor a different policy can collide with (and reuse) another's verdict.
+func signatureCacheKey(registry, digest string, reqs []PolicyRequirement) string {
+	data, _ := json.Marshal(reqs)
+	return fmt.Sprintf("%s\x00%s\x00%x", registry, digest, sha256.Sum256(data))
+}
+
+// VerifyManifestSignature enforces ic.Options.SignaturePolicy against
+// ic.ManifestDigest. It is a no-op when no policy is configured, so existing
+// pulls are unaffected unless PolicyPath/SignaturePolicy is explicitly set.
+func (ic *ImageC) VerifyManifestSignature(ctx context.Context) error {
+	policy := ic.Options.SignaturePolicy
+	if policy == nil {
+		return nil
+	}
+
+	// By now PullImage has replaced ic.Registry with the registry's full v2
+	// URL; policy entries are keyed by registry host.
+	registry := ic.Registry
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		registry = u.Host
+	}
+
+	reqs := policy.requirementsFor(registry, ic.Image)
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	for _, req := range reqs {
+		switch req.Type {
+		case PolicyReject:
+			return &SignatureVerificationError{Image: ic.Image, Digest: ic.ManifestDigest, Reason: "registry policy rejects this image"}
+		case PolicyInsecureAcceptAnything:
+			return nil
+		}
+	}
+
+	cacheKey := signatureCacheKey(registry, ic.ManifestDigest, reqs)
+
+	signatureVerificationCache.Lock()
+	if verified, cached := signatureVerificationCache.verified[cacheKey]; cached {
+		signatureVerificationCache.Unlock()
+		if !verified {
+			return &SignatureVerificationError{Image: ic.Image, Digest: ic.ManifestDigest, Reason: "no signature from an accepted key covers this digest"}
+		}
+		return nil
+	}
+	signatureVerificationCache.Unlock()
+
+	signatures, err := fetchSignatures(ctx, ic.Options, ic.ManifestDigest)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch signatures for %s@%s: %s", ic.Image, ic.ManifestDigest, err)
+	}
+
+	verified := satisfiesRequirements(reqs, ic.Image, ic.ManifestDigest, signatures)
+
+	signatureVerificationCache.Lock()
+	signatureVerificationCache.verified[cacheKey] = verified
+	signatureVerificationCache.Unlock()
+
+	if !verified {
+		return &SignatureVerificationError{Image: ic.Image, Digest: ic.ManifestDigest, Reason: "no signature from an accepted key covers this digest"}
+	}
+
+	return nil
+}
+
+// simpleSigningPayload is the JSON payload a "simple signing" signature
+// covers: an identity (repository reference) tied to a manifest digest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+	} `json:"critical"`
+}
+
+// satisfiesRequirements returns true if any signature satisfies at least one
+// of reqs for the given image/digest.
+func satisfiesRequirements(reqs []PolicyRequirement, image, digest string, signatures [][]byte) bool {
+	for _, req := range reqs {
+		for _, sig := range signatures {
+			switch req.Type {
+			case PolicySignedBy:
+				if verifyGPGSignature(req, image, digest, sig) {
+					return true
+				}
+			case PolicySigstoreSigned:
+				if verifySigstoreSignature(req, digest, sig) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// verifyGPGSignature checks that sig is a valid detached GPG "simple
+// signing" signature, from a key accepted by req, covering digest.
+func verifyGPGSignature(req PolicyRequirement, image, digest string, sig []byte) bool {
+	keyringData, err := ioutil.ReadFile(req.KeyPath)
+	if err != nil {
+		log.Warnf("Failed to read signedBy keyring %s: %s", req.KeyPath, err)
+		return false
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyringData))
+	if err != nil {
+		log.Warnf("Failed to parse signedBy keyring %s: %s", req.KeyPath, err)
+		return false
+	}
+
+	block, err := openpgp.ReadMessage(bytes.NewReader(sig), keyring, nil, nil)
+	if err != nil {
+		return false
+	}
+
+	payload, err := ioutil.ReadAll(block.UnverifiedBody)
+	if err != nil {
+		return false
+	}
+
+	if block.SignatureError != nil || block.SignedBy == nil {
+		return false
+	}
+
+	if len(req.KeyFingerprints) > 0 {
+		fingerprint := fmt.Sprintf("%X", block.SignedBy.PublicKey.Fingerprint)
+		if !containsFold(req.KeyFingerprints, fingerprint) {
+			return false
+		}
+	}
+
+	var signed simpleSigningPayload
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return false
+	}
+
+	return signed.Critical.Image.DockerManifestDigest == digest
+}
+
+// verifySigstoreSignature checks that sig is a valid ECDSA signature, over
+// sha256(digest), from the PEM public key at req.KeyPath.
+func verifySigstoreSignature(req PolicyRequirement, digest string, sig []byte) bool {
+	keyData, err := ioutil.ReadFile(req.KeyPath)
+	if err != nil {
+		log.Warnf("Failed to read sigstore public key %s: %s", req.KeyPath, err)
+		return false
+	}
+
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return false
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	ecdsaKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(digest))
+	return ecdsa.VerifyASN1(ecdsaKey, hash[:], sig)
+}
+
+func containsFold(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if strings.EqualFold(s, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// registrySignatureResponse is the body of a registry's
+// /extensions/v2/<name>/signatures/<digest> endpoint.
+type registrySignatureResponse struct {
+	Signatures []struct {
+		Content string `json:"content"`
+	} `json:"signatures"`
+}
+
+// fetchSignatures retrieves detached signatures covering digest, either from
+// options.SignatureLookasideURL if configured, or from the registry's
+// signature extension endpoint.
+func fetchSignatures(ctx context.Context, options Options, digest string) ([][]byte, error) {
+	if options.SignatureLookasideURL != "" {
+		return fetchLookasideSignatures(ctx, options, digest)
+	}
+	return fetchRegistrySignatures(ctx, options, digest)
+}
+
+func signatureHTTPClient(options Options) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:            options.RegistryCAs,
+				InsecureSkipVerify: options.InsecureSkipVerify,
+			},
+		},
+	}
+}
+
+func fetchRegistrySignatures(ctx context.Context, options Options, digest string) ([][]byte, error) {
+	// options.Registry is the registry's full v2 URL; only its scheme and
+	// host carry over to the extensions endpoint.
+	u, err := url.Parse(options.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s://%s/extensions/v2/%s/signatures/%s", u.Scheme, u.Host, options.Image, digest)
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := signatureHTTPClient(options).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature endpoint returned %s", resp.Status)
+	}
+
+	var parsed registrySignatureResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("Failed to decode signature response: %s", err)
+	}
+
+	return decodeSignatures(parsed.Signatures)
+}
+
+// fetchLookasideSignatures retrieves signatures from a sidecar HTTP(S)
+// lookaside, following containers/image's "<url>/<digest-algo>=<hex>/signature-<n>"
+// layout, stopping at the first missing sequence number.
+func fetchLookasideSignatures(ctx context.Context, options Options, digest string) ([][]byte, error) {
+	base := strings.TrimSuffix(options.SignatureLookasideURL, "/")
+	encodedDigest := strings.Replace(digest, ":", "=", 1)
+
+	var signatures [][]byte
+	client := signatureHTTPClient(options)
+
+	for i := 1; ; i++ {
+		url := fmt.Sprintf("%s/%s/signature-%d", base, encodedDigest, i)
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			break
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("lookaside signature endpoint returned %s", resp.Status)
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		signatures = append(signatures, data)
+	}
+
+	return signatures, nil
+}
+
+func decodeSignatures(entries []struct {
+	Content string `json:"content"`
+}) ([][]byte, error) {
+	signatures := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		data, err := base64.StdEncoding.DecodeString(e.Content)
+		if err != nil {
+			continue
+		}
+		signatures = append(signatures, data)
+	}
+	return signatures, nil
+}
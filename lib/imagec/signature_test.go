@@ -0,0 +1,62 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import "testing"
+
+func TestSignaturePolicyRequirementsFor(t *testing.T) {
+	policy := &SignaturePolicy{
+		Default: []PolicyRequirement{{Type: PolicyReject}},
+		Registries: map[string][]PolicyRequirement{
+			"registry.example.com":         {{Type: PolicyInsecureAcceptAnything}},
+			"registry.example.com/trusted": {{Type: PolicySignedBy, KeyPath: "/keys/trusted.gpg"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		registry string
+		image    string
+		expected PolicyRequirementType
+	}{
+		{"repository-specific entry wins", "registry.example.com", "trusted", PolicySignedBy},
+		{"bare registry entry", "registry.example.com", "untrusted", PolicyInsecureAcceptAnything},
+		{"falls back to default", "other.example.com", "anything", PolicyReject},
+	}
+
+	for _, test := range tests {
+		reqs := policy.requirementsFor(test.registry, test.image)
+		if len(reqs) != 1 || reqs[0].Type != test.expected {
+			t.Errorf("%s: requirementsFor(%q, %q) = %+v, expected a single %s requirement", test.name, test.registry, test.image, reqs, test.expected)
+		}
+	}
+}
+
+func TestSignatureCacheKeyScoping(t *testing.T) {
+	reqs := []PolicyRequirement{{Type: PolicySignedBy, KeyPath: "/keys/a.gpg"}}
+	otherReqs := []PolicyRequirement{{Type: PolicySignedBy, KeyPath: "/keys/b.gpg"}}
+
+	if signatureCacheKey("registry-a", "sha256:digest", reqs) == signatureCacheKey("registry-b", "sha256:digest", reqs) {
+		t.Error("expected different registries to produce different cache keys for the same digest")
+	}
+
+	if signatureCacheKey("registry-a", "sha256:digest", reqs) == signatureCacheKey("registry-a", "sha256:digest", otherReqs) {
+		t.Error("expected different policy requirements to produce different cache keys for the same registry and digest")
+	}
+
+	if signatureCacheKey("registry-a", "sha256:digest", reqs) != signatureCacheKey("registry-a", "sha256:digest", reqs) {
+		t.Error("expected the same registry, digest and requirements to produce the same cache key")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagec
+
+import "testing"
+
+func TestParseSourceReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected ParsedReference
+	}{
+		{"busybox:latest", ParsedReference{Transport: TransportDocker, Value: "busybox:latest"}},
+		{"docker://busybox:latest", ParsedReference{Transport: TransportDocker, Value: "busybox:latest"}},
+		{"docker-archive:/tmp/busybox.tar", ParsedReference{Transport: TransportDockerArchive, Value: "/tmp/busybox.tar"}},
+		{"oci-archive:/tmp/busybox.tar:latest", ParsedReference{Transport: TransportOCIArchive, Value: "/tmp/busybox.tar:latest"}},
+		{"oci:/tmp/layout:latest", ParsedReference{Transport: TransportOCILayout, Value: "/tmp/layout:latest"}},
+		{"dir:/tmp/layout", ParsedReference{Transport: TransportDir, Value: "/tmp/layout"}},
+	}
+
+	for _, test := range tests {
+		got := ParseSourceReference(test.ref)
+		if got != test.expected {
+			t.Errorf("ParseSourceReference(%q) = %+v, expected %+v", test.ref, got, test.expected)
+		}
+	}
+}
+
+func TestSplitPathAndTag(t *testing.T) {
+	tests := []struct {
+		value        string
+		expectedPath string
+		expectedTag  string
+	}{
+		{"/tmp/layout:latest", "/tmp/layout", "latest"},
+		{"/tmp/layout", "/tmp/layout", ""},
+		{"/tmp/has:colon/in/path", "/tmp/has:colon/in/path", ""},
+	}
+
+	for _, test := range tests {
+		path, tag := splitPathAndTag(test.value)
+		if path != test.expectedPath || tag != test.expectedTag {
+			t.Errorf("splitPathAndTag(%q) = (%q, %q), expected (%q, %q)", test.value, path, tag, test.expectedPath, test.expectedTag)
+		}
+	}
+}